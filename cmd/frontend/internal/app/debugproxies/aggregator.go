@@ -0,0 +1,216 @@
+package debugproxies
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/gorilla/mux"
+)
+
+// defaultAggregateConcurrency bounds how many endpoints of a service are
+// queried at once by an aggregate fan-out request.
+const defaultAggregateConcurrency = 8
+
+// defaultAggregateTimeout bounds how long a single endpoint is given to
+// respond to a fan-out request before it's treated as failed.
+const defaultAggregateTimeout = 30 * time.Second
+
+// FailedEndpointsHeader reports, on a partial-success aggregate response,
+// the display names of endpoints that could not be reached or, for a
+// profile, whose response did not parse as a pprof profile.
+const FailedEndpointsHeader = "X-Sourcegraph-Failed-Endpoints"
+
+// Aggregator fans a single request out to every healthy endpoint of a
+// service and combines their responses, so an operator can profile or
+// scrape an entire fleet (e.g. every gitserver replica) in one request
+// instead of one replica at a time.
+type Aggregator struct {
+	// Concurrency bounds how many endpoints are queried concurrently.
+	// Defaults to defaultAggregateConcurrency.
+	Concurrency int
+	// Timeout bounds how long a single endpoint is given to respond.
+	// Defaults to defaultAggregateTimeout.
+	Timeout time.Duration
+}
+
+func (a *Aggregator) concurrency() int {
+	if a.Concurrency > 0 {
+		return a.Concurrency
+	}
+	return defaultAggregateConcurrency
+}
+
+func (a *Aggregator) timeout() time.Duration {
+	if a.Timeout > 0 {
+		return a.Timeout
+	}
+	return defaultAggregateTimeout
+}
+
+type fanOutResult struct {
+	endpoint *endpointState
+	body     []byte
+	err      error
+}
+
+// fanOut queries path on every healthy endpoint of service concurrently,
+// bounded by a.concurrency() and a.timeout() per endpoint, and returns one
+// result per queried endpoint.
+func (a *Aggregator) fanOut(ctx context.Context, r *ReverseProxyHandler, service, path, rawQuery string) []fanOutResult {
+	now := time.Now()
+	failureWait := r.failureWait()
+
+	var healthy []*endpointState
+	for _, state := range r.sortedStates() {
+		if state.Service == service && state.isHealthy(now, failureWait) {
+			healthy = append(healthy, state)
+		}
+	}
+
+	results := make([]fanOutResult, len(healthy))
+	sem := make(chan struct{}, a.concurrency())
+	var wg sync.WaitGroup
+	for i, state := range healthy {
+		i, state := i, state
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = a.query(ctx, r, state, path, rawQuery)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (a *Aggregator) query(ctx context.Context, r *ReverseProxyHandler, state *endpointState, path, rawQuery string) fanOutResult {
+	reqCtx, cancel := context.WithTimeout(ctx, a.timeout())
+	defer cancel()
+
+	target := url.URL{Scheme: "http", Host: state.Host, Path: path, RawQuery: rawQuery}
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return fanOutResult{endpoint: state, err: err}
+	}
+
+	body, _, err := r.transportFor(state.Scheme).Do(reqCtx, state.Endpoint, req)
+	if err != nil {
+		return fanOutResult{endpoint: state, err: err}
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	return fanOutResult{endpoint: state, body: data, err: err}
+}
+
+func failedDisplayNames(results []fanOutResult) []string {
+	var failed []string
+	for _, res := range results {
+		if res.err != nil {
+			failed = append(failed, res.endpoint.displayName)
+		}
+	}
+	return failed
+}
+
+// ServeProfile implements
+// GET /-/debug/proxies/_all/{service}/pprof/profile?seconds=30: it collects
+// a pprof profile from every healthy endpoint of service and responds with
+// their merge.
+func (a *Aggregator) ServeProfile(r *ReverseProxyHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		service := mux.Vars(req)["service"]
+		results := a.fanOut(req.Context(), r, service, "/pprof/profile", req.URL.RawQuery)
+
+		var profiles []*profile.Profile
+		failed := failedDisplayNames(results)
+		for _, res := range results {
+			if res.err != nil {
+				continue
+			}
+			p, err := profile.Parse(bytes.NewReader(res.body))
+			if err != nil {
+				failed = append(failed, res.endpoint.displayName)
+				continue
+			}
+			profiles = append(profiles, p)
+		}
+
+		if len(profiles) == 0 {
+			http.Error(w, fmt.Sprintf("no endpoint of service %q returned a usable profile", service), http.StatusBadGateway)
+			return
+		}
+		merged, err := profile.Merge(profiles)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(failed) > 0 {
+			w.Header().Set(FailedEndpointsHeader, strings.Join(failed, ","))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := merged.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// ServeMetrics implements GET /-/debug/proxies/_all/{service}/metrics: it
+// concatenates Prometheus exposition output from every healthy endpoint of
+// service, prefixing each series with an instance="host:port" label so
+// scraping tools can distinguish replicas. Every endpoint's response is read
+// in full before any output is written; nothing is streamed.
+func (a *Aggregator) ServeMetrics(r *ReverseProxyHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		service := mux.Vars(req)["service"]
+		results := a.fanOut(req.Context(), r, service, "/metrics", "")
+
+		if failed := failedDisplayNames(results); len(failed) > 0 {
+			w.Header().Set(FailedEndpointsHeader, strings.Join(failed, ","))
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		for _, res := range results {
+			if res.err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(res.body), "\n") {
+				fmt.Fprintln(w, withInstanceLabel(line, res.endpoint.Host))
+			}
+		}
+	}
+}
+
+// withInstanceLabel adds an instance="host" label to a Prometheus exposition
+// line, leaving comment and blank lines untouched.
+func withInstanceLabel(line, host string) string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return line
+	}
+
+	name, rest := line, ""
+	if i := strings.IndexAny(line, "{ "); i >= 0 {
+		name, rest = line[:i], line[i:]
+	}
+
+	label := fmt.Sprintf(`instance=%q`, host)
+	if strings.HasPrefix(rest, "{") {
+		if rest == "{}" {
+			return name + "{" + label + "}"
+		}
+		return name + "{" + label + "," + rest[1:]
+	}
+	return name + "{" + label + "}" + rest
+}
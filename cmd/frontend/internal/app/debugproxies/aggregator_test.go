@@ -0,0 +1,209 @@
+package debugproxies
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/gorilla/mux"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/internal/app/router"
+)
+
+// syntheticProfile returns a minimal valid pprof profile with a single
+// sample of the given value, for use as fake endpoint output in tests.
+func syntheticProfile(t *testing.T, value int64) []byte {
+	t.Helper()
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:     []*profile.Sample{{Value: []int64{value}}},
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     1,
+		TimeNanos:  1,
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatalf("writing synthetic profile: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAggregateMetricsLabelsHealthyReplicasAndSkipsDownOnes(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("# HELP up 1 if the target is up\nup 1\n"))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	upURL, _ := url.Parse(up.URL)
+	downURL, _ := url.Parse(down.URL)
+
+	rph.Populate([]Endpoint{
+		{Service: "gitserver", Host: upURL.Host},
+		{Service: "gitserver", Host: downURL.Host},
+	})
+
+	// Mark the down replica failed so the aggregator's fan-out skips it,
+	// matching what would happen after a real failed proxy request.
+	rph.markFailed(displayNameFromEndpoint(Endpoint{Service: "gitserver", Host: downURL.Host}))
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("http://example.com/-/debug/proxies/_all/gitserver/metrics")
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	wantLine := fmt.Sprintf(`up{instance=%q} 1`, upURL.Host)
+	if !strings.Contains(string(body), wantLine) {
+		t.Errorf("expected metrics output to contain %q, got %s", wantLine, body)
+	}
+	if strings.Contains(string(body), downURL.Host) {
+		t.Errorf("expected the unhealthy replica to be skipped, got %s", body)
+	}
+}
+
+func TestAggregateProfileMergesHealthyReplicas(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	replica1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(syntheticProfile(t, 1))
+	}))
+	defer replica1.Close()
+	replica2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(syntheticProfile(t, 2))
+	}))
+	defer replica2.Close()
+
+	url1, _ := url.Parse(replica1.URL)
+	url2, _ := url.Parse(replica2.URL)
+	rph.Populate([]Endpoint{
+		{Service: "searcher", Host: url1.Host},
+		{Service: "searcher", Host: url2.Host},
+	})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := "http://example.com/-/debug/proxies/_all/searcher/pprof/profile"
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get(FailedEndpointsHeader); got != "" {
+		t.Errorf("expected no failed endpoints, got %q", got)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	merged, err := profile.Parse(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("parsing merged profile: %v", err)
+	}
+	var total int64
+	for _, s := range merged.Sample {
+		total += s.Value[0]
+	}
+	if total != 3 {
+		t.Errorf("expected merged profile's sample values to sum to 3 (1+2), got %d", total)
+	}
+}
+
+func TestAggregateProfileReturnsBadGatewayWhenAllEndpointsFail(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	downURL, _ := url.Parse(down.URL)
+	rph.Populate([]Endpoint{{Service: "searcher", Host: downURL.Host}})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := "http://example.com/-/debug/proxies/_all/searcher/pprof/profile"
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status %d when every endpoint fails, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+}
+
+func TestAggregateProfileReportsFailedEndpointsOnPartialSuccess(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(syntheticProfile(t, 1))
+	}))
+	defer up.Close()
+
+	// down is a healthy-per-the-pool endpoint (never marked failed) whose
+	// connection is refused at query time, so it surfaces as a genuine
+	// per-request fan-out failure rather than being filtered out up front.
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	downURL, _ := url.Parse(down.URL)
+	down.Close()
+
+	upURL, _ := url.Parse(up.URL)
+	downEndpoint := Endpoint{Service: "searcher", Host: downURL.Host}
+	rph.Populate([]Endpoint{
+		{Service: "searcher", Host: upURL.Host},
+		downEndpoint,
+	})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := "http://example.com/-/debug/proxies/_all/searcher/pprof/profile"
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 for a partial success, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get(FailedEndpointsHeader); got != displayNameFromEndpoint(downEndpoint) {
+		t.Errorf("expected %s to report the unreachable replica %q, got %q", FailedEndpointsHeader, displayNameFromEndpoint(downEndpoint), got)
+	}
+}
@@ -0,0 +1,61 @@
+package debugproxies
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// upstreamErrorContentType marks a response body as a structured error
+// envelope regardless of status code, analogous to krakend-lua's
+// HTTPResponseError/NamedHTTPResponseError.
+const upstreamErrorContentType = "application/vnd.sourcegraph.error+json"
+
+// UpstreamError is a structured error surfaced by an upstream debug
+// endpoint, recognized either via upstreamErrorContentType or a >=400
+// response whose body is JSON shaped like {code, msg, backend}. It lets the
+// debug UI show *which* replica failed with *what* reason during a partial
+// outage, instead of an opaque 502.
+type UpstreamError struct {
+	Endpoint string          `json:"endpoint"`
+	Service  string          `json:"service"`
+	Code     string          `json:"code"`
+	Msg      string          `json:"msg"`
+	Raw      json.RawMessage `json:"raw,omitempty"`
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream error from %s (%s): %s: %s", e.Endpoint, e.Service, e.Code, e.Msg)
+}
+
+// upstreamErrorBody is the JSON shape recognized on a plain >=400 response
+// that didn't declare upstreamErrorContentType.
+type upstreamErrorBody struct {
+	Code    string `json:"code"`
+	Msg     string `json:"msg"`
+	Backend string `json:"backend"`
+}
+
+// parseUpstreamError recognizes a structured upstream error in a response
+// body. An undeclared >=400 response yields nil unless its body is JSON with
+// a code or msg; a response declaring upstreamErrorContentType always yields
+// an error, with Code "unparseable" if its body isn't valid JSON.
+func parseUpstreamError(state *endpointState, statusCode int, contentType string, body []byte) *UpstreamError {
+	declared := strings.HasPrefix(contentType, upstreamErrorContentType)
+	if !declared && statusCode < 400 {
+		return nil
+	}
+
+	var parsed upstreamErrorBody
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		if !declared {
+			return nil // an arbitrary >=400 body isn't necessarily a structured error
+		}
+		return &UpstreamError{Endpoint: state.Host, Service: state.Service, Code: "unparseable", Msg: err.Error(), Raw: body}
+	}
+	if !declared && parsed.Code == "" && parsed.Msg == "" {
+		return nil // >=400 with unrelated JSON, not our error envelope
+	}
+
+	return &UpstreamError{Endpoint: state.Host, Service: state.Service, Code: parsed.Code, Msg: parsed.Msg, Raw: body}
+}
@@ -0,0 +1,123 @@
+package debugproxies
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/internal/app/router"
+)
+
+func TestStructuredUpstreamErrorIsNormalized(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	var hookedErr *UpstreamError
+	rph.ResponseHook = func(resp *http.Response, err *UpstreamError) {
+		hookedErr = err
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", upstreamErrorContentType)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"code":"searcher_unavailable","msg":"index not ready","backend":"searcher-0"}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("setup error %v", err)
+	}
+
+	ep := Endpoint{Service: "searcher", Host: upstreamURL.Host}
+	displayName := displayNameFromEndpoint(ep)
+	rph.Populate([]Endpoint{ep})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("%s/-/debug/proxies/%s/search", upstream.URL, displayName)
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	var envelope struct {
+		Error *UpstreamError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatalf("expected a JSON error envelope, got %s: %v", body, err)
+	}
+	if envelope.Error == nil || envelope.Error.Code != "searcher_unavailable" {
+		t.Errorf("expected normalized error with code searcher_unavailable, got %+v", envelope.Error)
+	}
+	if hookedErr == nil || hookedErr.Code != "searcher_unavailable" {
+		t.Errorf("expected ResponseHook to observe the same UpstreamError, got %+v", hookedErr)
+	}
+}
+
+// TestResponseHookPassesSuccessfulResponsesThrough checks that installing a
+// ResponseHook (for logging or metrics) leaves a successful proxied response
+// intact for the client, and that the hook sees it with a nil UpstreamError.
+func TestResponseHookPassesSuccessfulResponsesThrough(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	var hookedErr *UpstreamError
+	hookCalled := false
+	rph.ResponseHook = func(resp *http.Response, err *UpstreamError) {
+		hookCalled = true
+		hookedErr = err
+	}
+
+	const payload = "pprof profile bytes"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("setup error %v", err)
+	}
+
+	ep := Endpoint{Service: "searcher", Host: upstreamURL.Host}
+	displayName := displayNameFromEndpoint(ep)
+	rph.Populate([]Endpoint{ep})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("%s/-/debug/proxies/%s/pprof/profile", upstream.URL, displayName)
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != payload {
+		t.Errorf("expected client to receive %q, got %q", payload, body)
+	}
+	if !hookCalled {
+		t.Error("expected ResponseHook to be called for a successful response")
+	}
+	if hookedErr != nil {
+		t.Errorf("expected ResponseHook to observe a nil UpstreamError for a successful response, got %+v", hookedErr)
+	}
+}
@@ -0,0 +1,402 @@
+// Package debugproxies implements authenticated reverse proxies to the debug
+// (pprof, metrics, ...) endpoints of internal services such as gitserver and
+// searcher, so operators can inspect a running replica without exposing those
+// ports outside the cluster.
+package debugproxies
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultFailureWait is how long an endpoint is left out of rotation after a
+// failed request, before it is given another chance.
+const defaultFailureWait = 5 * time.Second
+
+// defaultRefreshInterval is how often GetEndpoints is polled for changes.
+const defaultRefreshInterval = 15 * time.Second
+
+// Endpoint is a single backend replica of a proxied service, as reported by
+// the relevant service discovery mechanism (Kubernetes endpoints, etcd, ...).
+type Endpoint struct {
+	Service string
+	Host    string
+
+	// Scheme selects which registered Transport reaches this endpoint, e.g.
+	// "http" (the default, used when empty) or "grpc". See Transport.
+	Scheme string
+}
+
+// endpointState tracks the liveness of a single Endpoint alongside the data
+// needed to render and route to it.
+type endpointState struct {
+	Endpoint
+	displayName string
+	failed      time.Time
+}
+
+// isHealthy reports whether the endpoint is currently eligible for use,
+// i.e. it has never failed or its cooldown has elapsed.
+func (e *endpointState) isHealthy(now time.Time, failureWait time.Duration) bool {
+	return e.failed.IsZero() || now.Sub(e.failed) > failureWait
+}
+
+// ReverseProxyHandler reverse proxies requests to a pool of internal service
+// endpoints. It renders an index page at "/", a machine-readable equivalent
+// at "/proxies.json", and proxies everything under
+// "/proxies/{displayName}/..." to the matching endpoint.
+//
+// The pool tracks per-endpoint health: an endpoint that returns a 5xx or a
+// transport error is skipped for proxying, and shown with is_available=false
+// on the index page and in proxies.json, until its failureWait cooldown
+// elapses. This keeps a single unhealthy
+// replica, e.g. a gitserver pod mid-rollout, from making every hit to
+// /-/debug/ fail or hang.
+type ReverseProxyHandler struct {
+	// FailureWait overrides defaultFailureWait when non-zero.
+	FailureWait time.Duration
+
+	// GetEndpoints, when set, is polled every RefreshInterval to keep the
+	// pool in sync with service discovery. Results are merged into the
+	// existing pool, preserving failure state for endpoints that are still
+	// present. Analogous to etcd's GetProxyURLs.
+	GetEndpoints func() ([]Endpoint, error)
+
+	// RefreshInterval overrides defaultRefreshInterval when non-zero.
+	RefreshInterval time.Duration
+
+	mu        sync.RWMutex
+	endpoints map[string]*endpointState // keyed by displayName
+
+	startRefresh sync.Once
+
+	servicesMu sync.RWMutex
+	services   map[string]*ProxiedService // keyed by ProxiedService.Name
+
+	// Transports overrides the Transport used for a given Endpoint.Scheme.
+	// Schemes with no entry here fall back to the package-level defaults
+	// (HTTPTransport for "http"/"").
+	Transports map[string]Transport
+
+	// ResponseHook, if set, is called with every proxied response and the
+	// UpstreamError recognized from it, if any (nil for a successful
+	// response). Useful for logging or metrics; it does not affect what's
+	// written to the client, and does not force successful responses to be
+	// buffered in memory before they're streamed to the client.
+	ResponseHook func(*http.Response, *UpstreamError)
+
+	// Aggregator serves the "/proxies/_all/{service}/..." fan-out routes.
+	// The zero value is usable and applies the default concurrency/timeout.
+	Aggregator Aggregator
+}
+
+// transportFor resolves the Transport to use for scheme, falling back to the
+// built-in defaults when the handler hasn't overridden it.
+func (r *ReverseProxyHandler) transportFor(scheme string) Transport {
+	if t, ok := r.Transports[scheme]; ok {
+		return t
+	}
+	if t, ok := defaultTransports[scheme]; ok {
+		return t
+	}
+	return HTTPTransport{}
+}
+
+// displayNameFromEndpoint derives a stable, URL-safe identifier for an
+// endpoint from its service name and host, e.g. "gitserver-10.0.1.4:6060".
+func displayNameFromEndpoint(e Endpoint) string {
+	return fmt.Sprintf("%s-%s", e.Service, e.Host)
+}
+
+// Populate (re)initializes the pool with the given endpoints, preserving
+// failure state for any endpoint that is still present. It also starts the
+// background refresh loop on first use if GetEndpoints is set.
+func (r *ReverseProxyHandler) Populate(endpoints []Endpoint) {
+	r.mu.Lock()
+	next := make(map[string]*endpointState, len(endpoints))
+	for _, ep := range endpoints {
+		displayName := displayNameFromEndpoint(ep)
+		state := &endpointState{Endpoint: ep, displayName: displayName}
+		if prev, ok := r.endpoints[displayName]; ok {
+			state.failed = prev.failed
+		}
+		next[displayName] = state
+	}
+	r.endpoints = next
+	r.mu.Unlock()
+
+	r.startRefresh.Do(func() {
+		if r.GetEndpoints != nil {
+			go r.refreshLoop()
+		}
+	})
+}
+
+// refreshLoop periodically re-polls GetEndpoints and merges the results into
+// the pool until the process exits.
+func (r *ReverseProxyHandler) refreshLoop() {
+	interval := r.RefreshInterval
+	if interval == 0 {
+		interval = defaultRefreshInterval
+	}
+	for range time.Tick(interval) {
+		endpoints, err := r.GetEndpoints()
+		if err != nil {
+			log.Printf("debugproxies: failed to refresh endpoints: %v", err)
+			continue
+		}
+		r.Populate(endpoints)
+	}
+}
+
+func (r *ReverseProxyHandler) failureWait() time.Duration {
+	if r.FailureWait > 0 {
+		return r.FailureWait
+	}
+	return defaultFailureWait
+}
+
+// markFailed records a failed request against the endpoint with the given
+// display name, taking it out of rotation until the failure cooldown lapses.
+func (r *ReverseProxyHandler) markFailed(displayName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state, ok := r.endpoints[displayName]; ok {
+		state.failed = time.Now()
+	}
+}
+
+// sortedStates returns a snapshot of the pool's endpoints sorted by display
+// name, for stable index/JSON rendering.
+func (r *ReverseProxyHandler) sortedStates() []*endpointState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	states := make([]*endpointState, 0, len(r.endpoints))
+	for _, state := range r.endpoints {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].displayName < states[j].displayName })
+	return states
+}
+
+// endpoint looks up the endpoint with the given display name, regardless of
+// its health, so serveReverseProxy can still find the service of a down
+// endpoint and fall back to another replica of it.
+func (r *ReverseProxyHandler) endpoint(displayName string) (*endpointState, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	state, ok := r.endpoints[displayName]
+	return state, ok
+}
+
+// pick returns a random healthy endpoint for service. If every endpoint for
+// that service is currently unhealthy, it falls back to the
+// least-recently-failed one so the caller still gets somewhere to proxy to
+// rather than a hard failure.
+func (r *ReverseProxyHandler) pick(service string) (*endpointState, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	failureWait := r.failureWait()
+
+	var healthy []*endpointState
+	var leastRecentlyFailed *endpointState
+	for _, state := range r.endpoints {
+		if state.Service != service {
+			continue
+		}
+		if state.isHealthy(now, failureWait) {
+			healthy = append(healthy, state)
+		}
+		if leastRecentlyFailed == nil || state.failed.Before(leastRecentlyFailed.failed) {
+			leastRecentlyFailed = state
+		}
+	}
+
+	if len(healthy) > 0 {
+		return healthy[rand.Intn(len(healthy))], true
+	}
+	if leastRecentlyFailed != nil {
+		return leastRecentlyFailed, true
+	}
+	return nil, false
+}
+
+var indexPageTmpl = template.Must(template.New("index").Parse(`{{range .}}<a href="proxies/{{.DisplayName}}/">{{.DisplayName}}</a> is_available={{.IsAvailable}} last_failure={{.LastFailure}}<br>{{end}}`))
+
+type indexRow struct {
+	DisplayName string
+	IsAvailable bool
+	LastFailure string
+}
+
+func (r *ReverseProxyHandler) serveIndex(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	failureWait := r.failureWait()
+
+	var rows []indexRow
+	for _, state := range r.sortedStates() {
+		row := indexRow{DisplayName: state.displayName, IsAvailable: state.isHealthy(now, failureWait)}
+		if !state.failed.IsZero() {
+			row.LastFailure = state.failed.Format(time.RFC3339)
+		}
+		rows = append(rows, row)
+	}
+
+	if err := indexPageTmpl.Execute(w, rows); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type proxyJSONEntry struct {
+	Service     string `json:"service"`
+	Host        string `json:"host"`
+	DisplayName string `json:"display_name"`
+	IsAvailable bool   `json:"is_available"`
+	LastFailure string `json:"last_failure,omitempty"`
+}
+
+// serveJSON implements /-/debug/proxies.json, a machine-readable view of the
+// pool's health for programmatic consumption.
+func (r *ReverseProxyHandler) serveJSON(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	failureWait := r.failureWait()
+
+	states := r.sortedStates()
+	entries := make([]proxyJSONEntry, 0, len(states))
+	for _, state := range states {
+		entry := proxyJSONEntry{
+			Service:     state.Service,
+			Host:        state.Host,
+			DisplayName: state.displayName,
+			IsAvailable: state.isHealthy(now, failureWait),
+		}
+		if !state.failed.IsZero() {
+			entry.LastFailure = state.failed.Format(time.RFC3339)
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *ReverseProxyHandler) serveReverseProxy(w http.ResponseWriter, req *http.Request) {
+	displayName := mux.Vars(req)["displayName"]
+
+	requested, ok := r.endpoint(displayName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such endpoint %q", displayName), http.StatusNotFound)
+		return
+	}
+
+	// Degrade gracefully: if the specific replica the caller asked for is
+	// currently unhealthy, proxy to another healthy replica of the same
+	// service instead of hammering a pod that's known to be down.
+	state := requested
+	if !requested.isHealthy(time.Now(), r.failureWait()) {
+		if alt, ok := r.pick(requested.Service); ok {
+			state = alt
+		}
+	}
+
+	prefix := fmt.Sprintf("/proxies/%s", displayName)
+	upstreamPath := req.URL.Path
+	if i := strings.Index(req.URL.Path, prefix); i >= 0 {
+		upstreamPath = req.URL.Path[i+len(prefix):]
+	}
+	outReq := req.Clone(req.Context())
+	outReq.URL.Path = upstreamPath
+	outReq.URL.RawPath = ""
+
+	body, header, err := r.transportFor(state.Scheme).Do(req.Context(), state.Endpoint, outReq)
+	if err != nil {
+		r.markFailed(state.displayName)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+
+	statusCode := http.StatusOK
+	if v := header.Get(upstreamStatusHeader); v != "" {
+		header.Del(upstreamStatusHeader)
+		if code, err := strconv.Atoi(v); err == nil {
+			statusCode = code
+		}
+	}
+	if statusCode >= 500 {
+		r.markFailed(state.displayName)
+	}
+
+	contentType := header.Get("Content-Type")
+	if statusCode >= 400 || strings.HasPrefix(contentType, upstreamErrorContentType) {
+		raw, _ := ioutil.ReadAll(body)
+
+		upstreamErr := parseUpstreamError(state, statusCode, contentType, raw)
+		if r.ResponseHook != nil {
+			r.ResponseHook(&http.Response{StatusCode: statusCode, Header: header}, upstreamErr)
+		}
+
+		if upstreamErr != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(statusCode)
+			_ = json.NewEncoder(w).Encode(struct {
+				Error *UpstreamError `json:"error"`
+			}{Error: upstreamErr})
+			return
+		}
+
+		for k, vs := range header {
+			for _, v := range vs {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(statusCode)
+		_, _ = w.Write(raw)
+		return
+	}
+
+	if r.ResponseHook != nil {
+		r.ResponseHook(&http.Response{StatusCode: statusCode, Header: header}, nil)
+	}
+
+	for k, vs := range header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(statusCode)
+	_, _ = io.Copy(w, body)
+}
+
+// AddToRouter registers the index, JSON, proxy, proxied-service, and
+// aggregate fan-out routes onto router, which is expected to already be
+// scoped to the "/-/debug" prefix.
+func (r *ReverseProxyHandler) AddToRouter(router *mux.Router) {
+	router.Path("/").HandlerFunc(r.serveIndex)
+	router.Path("/proxies.json").HandlerFunc(r.serveJSON)
+	// The _all fan-out routes must be registered before the generic
+	// "{displayName}" proxy route below, since mux otherwise matches "_all"
+	// as a (nonexistent) display name.
+	router.PathPrefix("/proxies/_all/{service}/pprof/profile").HandlerFunc(r.Aggregator.ServeProfile(r))
+	router.PathPrefix("/proxies/_all/{service}/metrics").HandlerFunc(r.Aggregator.ServeMetrics(r))
+	router.PathPrefix("/proxies/{displayName}/").HandlerFunc(r.serveReverseProxy)
+	router.PathPrefix("/services/{name}/").HandlerFunc(r.serveProxiedService)
+}
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
@@ -89,9 +90,135 @@ func TestIndexLinks(t *testing.T) {
 	resp := w.Result()
 	body, _ := ioutil.ReadAll(resp.Body)
 
-	expectedContent := fmt.Sprintf("<a href=\"proxies/%s/\">%s</a><br>", displayName, displayName)
+	expectedContent := fmt.Sprintf("<a href=\"proxies/%s/\">%s</a> is_available=true last_failure=<br>", displayName, displayName)
 
 	if string(body) != expectedContent {
 		t.Errorf("expected %s, got %s", expectedContent, body)
 	}
 }
+
+func TestUnhealthyEndpointFallsBackToAnotherReplica(t *testing.T) {
+	var rph ReverseProxyHandler
+	rph.FailureWait = time.Hour
+
+	downServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer downServer.Close()
+	upServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upServer.Close()
+
+	downURL, _ := url.Parse(downServer.URL)
+	upURL, _ := url.Parse(upServer.URL)
+
+	down := Endpoint{Service: "gitserver", Host: downURL.Host}
+	up := Endpoint{Service: "gitserver", Host: upURL.Host}
+	rph.Populate([]Endpoint{down, up})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	do := func(displayName string) *http.Response {
+		req := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/-/debug/proxies/%s/metrics", displayName), nil)
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		rtr.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	// First hit the down endpoint so it gets marked failed.
+	do(displayNameFromEndpoint(down))
+
+	// A subsequent request for the down endpoint's display name should be
+	// served by the healthy replica instead.
+	resp := do(displayNameFromEndpoint(down))
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Errorf("expected request to fall back to the healthy replica, got %q", body)
+	}
+}
+
+func TestPopulatePreservesFailureStateAcrossReMerge(t *testing.T) {
+	var rph ReverseProxyHandler
+	ep := Endpoint{Service: "gitserver", Host: "127.0.0.1:1"}
+	displayName := displayNameFromEndpoint(ep)
+
+	rph.Populate([]Endpoint{ep})
+	rph.markFailed(displayName)
+
+	state, ok := rph.endpoint(displayName)
+	if !ok || state.failed.IsZero() {
+		t.Fatalf("expected endpoint to be marked failed before re-populating")
+	}
+	failedAt := state.failed
+
+	// Re-merging the same endpoint (as a real GetEndpoints poll would) must
+	// preserve its failure state rather than resetting it.
+	rph.Populate([]Endpoint{ep})
+
+	state, ok = rph.endpoint(displayName)
+	if !ok {
+		t.Fatalf("expected endpoint to still be present after re-populating")
+	}
+	if !state.failed.Equal(failedAt) {
+		t.Errorf("expected failed timestamp %v to survive a re-merge, got %v", failedAt, state.failed)
+	}
+}
+
+func TestPopulateDropsFailureStateForAbsentEndpoint(t *testing.T) {
+	var rph ReverseProxyHandler
+	ep := Endpoint{Service: "gitserver", Host: "127.0.0.1:1"}
+	displayName := displayNameFromEndpoint(ep)
+
+	rph.Populate([]Endpoint{ep})
+	rph.markFailed(displayName)
+
+	// A merge that doesn't include ep at all drops it from the pool; if it
+	// reappears in a later merge it should start out healthy again, not
+	// remember a failure from before it was gone.
+	rph.Populate(nil)
+	rph.Populate([]Endpoint{ep})
+
+	state, ok := rph.endpoint(displayName)
+	if !ok {
+		t.Fatalf("expected endpoint to be present again")
+	}
+	if !state.failed.IsZero() {
+		t.Errorf("expected failure state to be dropped once the endpoint was absent from a merge, got %v", state.failed)
+	}
+}
+
+func TestRefreshLoopPollsGetEndpointsAndMergesResults(t *testing.T) {
+	var rph ReverseProxyHandler
+	rph.RefreshInterval = 10 * time.Millisecond
+
+	ep := Endpoint{Service: "gitserver", Host: "127.0.0.1:1"}
+	polls := make(chan struct{}, 10)
+	rph.GetEndpoints = func() ([]Endpoint, error) {
+		select {
+		case polls <- struct{}{}:
+		default:
+		}
+		return []Endpoint{ep}, nil
+	}
+
+	// The first Populate call starts the background refresh loop when
+	// GetEndpoints is already set, even with an empty initial endpoint list.
+	rph.Populate(nil)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-polls:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for refreshLoop poll %d", i+1)
+		}
+	}
+
+	if _, ok := rph.endpoint(displayNameFromEndpoint(ep)); !ok {
+		t.Error("expected refreshLoop to merge GetEndpoints' result into the pool")
+	}
+}
@@ -0,0 +1,193 @@
+package debugproxies
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ProxiedService describes an arbitrary internal HTTP service that should be
+// reachable through the frontend's existing operator authentication at
+// "/-/debug/services/{name}/...", instead of standing up a separate ingress
+// rule for it (e.g. an internal Jaeger, a Grafana datasource proxy, or a
+// blob store admin endpoint).
+type ProxiedService struct {
+	// Name identifies the service in the "/-/debug/services/{name}/..." path.
+	Name string
+	// Endpoints are the addresses to forward to; one is chosen at random per
+	// request.
+	Endpoints []Endpoint
+	// PathPrefix is stripped, together with "/services/{name}", from the
+	// incoming request path before it is forwarded upstream.
+	PathPrefix string
+	// UpstreamAuth, if set, is applied to the outgoing request before it is
+	// sent upstream, e.g. to inject a service-to-service bearer token.
+	UpstreamAuth func(*http.Request)
+	// AllowedMethods restricts which HTTP methods are forwarded; empty means
+	// all methods are allowed.
+	AllowedMethods []string
+	// MaxBodyBytes caps the size of the request body streamed upstream; zero
+	// means unlimited.
+	MaxBodyBytes int64
+	// ForwardSensitiveHeaders allows the caller's Cookie and Authorization
+	// headers to be forwarded upstream verbatim. Off by default, since
+	// ProxiedService fronts arbitrary operator-registered internal services
+	// (Jaeger, Grafana, ...) that should not receive the frontend session's
+	// credentials; use UpstreamAuth instead to authenticate to the upstream.
+	ForwardSensitiveHeaders bool
+}
+
+// hopByHopHeaders are stripped from both the forwarded request and the
+// returned response, per RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailers", "Transfer-Encoding", "Upgrade",
+}
+
+// sensitiveRequestHeaders carry the caller's own credentials and are never
+// meant for an unrelated upstream service; see ProxiedService.ForwardSensitiveHeaders.
+var sensitiveRequestHeaders = []string{"Cookie", "Authorization"}
+
+func sanitizeHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, hh := range hopByHopHeaders {
+		out.Del(hh)
+	}
+	return out
+}
+
+// sanitizeRequestHeaders is like sanitizeHeaders, but additionally strips the
+// caller's Cookie and Authorization headers unless forwardSensitive is set.
+func sanitizeRequestHeaders(h http.Header, forwardSensitive bool) http.Header {
+	out := sanitizeHeaders(h)
+	if !forwardSensitive {
+		for _, hh := range sensitiveRequestHeaders {
+			out.Del(hh)
+		}
+	}
+	return out
+}
+
+func allowedMethod(svc *ProxiedService, method string) bool {
+	if len(svc.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range svc.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterService adds (or replaces) a ProxiedService, making it reachable at
+// "/-/debug/services/{svc.Name}/...".
+func (r *ReverseProxyHandler) RegisterService(svc ProxiedService) {
+	r.servicesMu.Lock()
+	defer r.servicesMu.Unlock()
+	if r.services == nil {
+		r.services = make(map[string]*ProxiedService)
+	}
+	svcCopy := svc
+	r.services[svc.Name] = &svcCopy
+}
+
+func (r *ReverseProxyHandler) service(name string) (*ProxiedService, bool) {
+	r.servicesMu.RLock()
+	defer r.servicesMu.RUnlock()
+	svc, ok := r.services[name]
+	return svc, ok
+}
+
+// serveProxiedService streams a request through to one of svc's endpoints.
+// The request body is piped upstream rather than buffered, so large uploads
+// (e.g. a blob store PUT) don't have to fit in RAM, unless svc.MaxBodyBytes
+// is set, in which case the body is read up to the limit so an oversized
+// request can be rejected instead of silently truncated.
+func (r *ReverseProxyHandler) serveProxiedService(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	svc, ok := r.service(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such service %q", name), http.StatusNotFound)
+		return
+	}
+	if !allowedMethod(svc, req.Method) {
+		http.Error(w, fmt.Sprintf("method %s is not allowed for service %q", req.Method, name), http.StatusMethodNotAllowed)
+		return
+	}
+	if len(svc.Endpoints) == 0 {
+		http.Error(w, fmt.Sprintf("service %q has no endpoints", name), http.StatusServiceUnavailable)
+		return
+	}
+	endpoint := svc.Endpoints[rand.Intn(len(svc.Endpoints))]
+
+	prefix := path.Join("/services", name, svc.PathPrefix)
+	upstreamPath := req.URL.Path
+	if i := strings.Index(req.URL.Path, prefix); i >= 0 {
+		upstreamPath = req.URL.Path[i+len(prefix):]
+	}
+	if !strings.HasPrefix(upstreamPath, "/") {
+		upstreamPath = "/" + upstreamPath
+	}
+	target := url.URL{Scheme: "http", Host: endpoint.Host, Path: upstreamPath, RawQuery: req.URL.RawQuery}
+
+	var upstreamBody io.Reader
+	if svc.MaxBodyBytes > 0 {
+		// Read one byte past the limit so an oversized body can be rejected
+		// with 413 instead of silently truncated: if we come back with more
+		// than MaxBodyBytes, the body didn't fit.
+		buf, err := ioutil.ReadAll(io.LimitReader(req.Body, svc.MaxBodyBytes+1))
+		req.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(len(buf)) > svc.MaxBodyBytes {
+			http.Error(w, fmt.Sprintf("request body for service %q exceeds %d byte limit", name, svc.MaxBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		upstreamBody = bytes.NewReader(buf)
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			defer req.Body.Close()
+			_, err := io.Copy(pw, req.Body)
+			pw.CloseWithError(err)
+		}()
+		upstreamBody = pr
+	}
+
+	upstreamReq, err := http.NewRequestWithContext(req.Context(), req.Method, target.String(), upstreamBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upstreamReq.Header = sanitizeRequestHeaders(req.Header, svc.ForwardSensitiveHeaders)
+	if svc.UpstreamAuth != nil {
+		svc.UpstreamAuth(upstreamReq)
+	}
+
+	resp, err := http.DefaultClient.Do(upstreamReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	respHeader := sanitizeHeaders(resp.Header)
+	for k, vs := range respHeader {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
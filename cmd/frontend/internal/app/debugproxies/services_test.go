@@ -0,0 +1,181 @@
+package debugproxies
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/internal/app/router"
+)
+
+func TestProxiedServiceStripsPrefixAndStreamsBody(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("setup error %v", err)
+	}
+
+	rph.RegisterService(ProxiedService{
+		Name:      "jaeger",
+		Endpoints: []Endpoint{{Service: "jaeger", Host: upstreamURL.Host}},
+	})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("%s/-/debug/services/jaeger/trace/1", upstream.URL)
+	req := httptest.NewRequest("POST", link, strings.NewReader("payload"))
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if string(body) != "/trace/1" {
+		t.Errorf("expected upstream to see /trace/1, got %s", body)
+	}
+	if gotBody != "payload" {
+		t.Errorf("expected upstream to receive streamed body %q, got %q", "payload", gotBody)
+	}
+}
+
+func TestProxiedServiceStripsCookieAndAuthorizationByDefault(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	var gotCookie, gotAuth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCookie = r.Header.Get("Cookie")
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("setup error %v", err)
+	}
+
+	rph.RegisterService(ProxiedService{
+		Name:      "grafana",
+		Endpoints: []Endpoint{{Service: "grafana", Host: upstreamURL.Host}},
+	})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("%s/-/debug/services/grafana/dashboards", upstream.URL)
+	req := httptest.NewRequest("GET", link, nil)
+	req.Header.Set("Cookie", "sgsession=secret")
+	req.Header.Set("Authorization", "Bearer secret")
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	if gotCookie != "" {
+		t.Errorf("expected Cookie header to be stripped, upstream saw %q", gotCookie)
+	}
+	if gotAuth != "" {
+		t.Errorf("expected Authorization header to be stripped, upstream saw %q", gotAuth)
+	}
+}
+
+func TestProxiedServiceForwardsSensitiveHeadersWhenOptedIn(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	var gotCookie string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCookie = r.Header.Get("Cookie")
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("setup error %v", err)
+	}
+
+	rph.RegisterService(ProxiedService{
+		Name:                    "grafana",
+		Endpoints:               []Endpoint{{Service: "grafana", Host: upstreamURL.Host}},
+		ForwardSensitiveHeaders: true,
+	})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("%s/-/debug/services/grafana/dashboards", upstream.URL)
+	req := httptest.NewRequest("GET", link, nil)
+	req.Header.Set("Cookie", "sgsession=secret")
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	if gotCookie != "sgsession=secret" {
+		t.Errorf("expected Cookie header to be forwarded when opted in, upstream saw %q", gotCookie)
+	}
+}
+
+func TestProxiedServiceRejectsOversizedBody(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	upstreamHit := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHit = true
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("setup error %v", err)
+	}
+
+	rph.RegisterService(ProxiedService{
+		Name:         "blobstore",
+		Endpoints:    []Endpoint{{Service: "blobstore", Host: upstreamURL.Host}},
+		MaxBodyBytes: 4,
+	})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("%s/-/debug/services/blobstore/put/1", upstream.URL)
+	req := httptest.NewRequest("PUT", link, strings.NewReader("too big"))
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+	if upstreamHit {
+		t.Error("expected the oversized request to be rejected before reaching upstream")
+	}
+}
@@ -0,0 +1,199 @@
+package debugproxies
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// upstreamStatusHeader carries the upstream HTTP status code through a
+// Transport's returned header, since Transport.Do otherwise has no way to
+// report it alongside a streamed body. serveReverseProxy strips it before
+// writing the response to the caller.
+const upstreamStatusHeader = "X-Debugproxies-Upstream-Status"
+
+// Transport abstracts how a debug request reaches an Endpoint, so services
+// that expose their debug surface over something other than a second plain
+// HTTP listener (e.g. gitserver's existing gRPC admin server) can be wired in
+// without touching the proxying logic in ReverseProxyHandler.
+type Transport interface {
+	// Do dispatches req to endpoint and returns the response body and
+	// header to stream back to the caller. The caller closes the body.
+	Do(ctx context.Context, endpoint Endpoint, req *http.Request) (io.ReadCloser, http.Header, error)
+}
+
+// transportFunc adapts a plain function to a Transport, analogous to
+// http.HandlerFunc. Mainly useful for tests.
+type transportFunc func(ctx context.Context, endpoint Endpoint, req *http.Request) (io.ReadCloser, http.Header, error)
+
+func (f transportFunc) Do(ctx context.Context, endpoint Endpoint, req *http.Request) (io.ReadCloser, http.Header, error) {
+	return f(ctx, endpoint, req)
+}
+
+// defaultTransports maps Endpoint.Scheme to the Transport used when a
+// ReverseProxyHandler hasn't overridden it via its Transports field.
+var defaultTransports = map[string]Transport{
+	"":     HTTPTransport{},
+	"http": HTTPTransport{},
+	"grpc": GRPCTransport{},
+}
+
+// HTTPTransport is the default Transport, used for endpoints with Scheme
+// "http" (or the empty string). It proxies over a plain http.RoundTripper.
+type HTTPTransport struct {
+	// RoundTripper defaults to http.DefaultTransport when nil.
+	RoundTripper http.RoundTripper
+}
+
+func (t HTTPTransport) Do(ctx context.Context, endpoint Endpoint, req *http.Request) (io.ReadCloser, http.Header, error) {
+	rt := t.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	outReq := req.Clone(ctx)
+	outReq.URL.Scheme = "http"
+	outReq.URL.Host = endpoint.Host
+	outReq.RequestURI = ""
+
+	resp, err := rt.RoundTrip(outReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := resp.Header.Clone()
+	header.Set(upstreamStatusHeader, strconv.Itoa(resp.StatusCode))
+	return resp.Body, header, nil
+}
+
+// debugRequest is the tiny request envelope GRPCTransport sends as the first
+// (and only) message of its stream, describing the HTTP request being
+// proxied in terms the remote debug service understands.
+type debugRequest struct {
+	Path     string `json:"path"`
+	RawQuery string `json:"rawQuery,omitempty"`
+}
+
+// GRPCTransport reaches an Endpoint over its gRPC listener instead of a
+// second HTTP port, modeled after Workhorse's Gitaly smarthttp shim: the
+// remote service streams pprof/metrics chunks back over a single
+// server-streaming RPC rather than exposing an extra debug port.
+//
+// Messages are exchanged as raw bytes via the "raw" codec (see rawCodec)
+// rather than generated proto types, so this package doesn't need to import
+// the proto package of every service it might front.
+type GRPCTransport struct {
+	// Method is the fully-qualified gRPC method invoked for every request,
+	// e.g. "/sourcegraph.gitserver.v1.DebugService/StreamDebug". Defaults to
+	// defaultGRPCDebugMethod when empty.
+	Method string
+	// DialOptions are passed to grpc.DialContext; defaults to
+	// grpc.WithInsecure() when empty.
+	DialOptions []grpc.DialOption
+}
+
+const defaultGRPCDebugMethod = "/sourcegraph.debugproxies.v1.DebugService/StreamDebug"
+
+func (t GRPCTransport) Do(ctx context.Context, endpoint Endpoint, req *http.Request) (io.ReadCloser, http.Header, error) {
+	method := t.Method
+	if method == "" {
+		method = defaultGRPCDebugMethod
+	}
+
+	opts := t.DialOptions
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithInsecure()}
+	}
+
+	conn, err := grpc.DialContext(ctx, endpoint.Host, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dialing %s over grpc: %w", endpoint.Host, err)
+	}
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method, grpc.CallContentSubtype(rawCodecName))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reqBytes, err := json.Marshal(debugRequest{Path: req.URL.Path, RawQuery: req.URL.RawQuery})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := stream.SendMsg(&reqBytes); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	header := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	header.Set(upstreamStatusHeader, strconv.Itoa(http.StatusOK))
+	return &grpcChunkReader{stream: stream, conn: conn}, header, nil
+}
+
+// grpcChunkReader adapts a gRPC server-streaming RPC using the raw codec
+// into an io.ReadCloser, buffering any bytes left over from a RecvMsg call
+// that don't fit in the caller's Read buffer.
+type grpcChunkReader struct {
+	stream grpc.ClientStream
+	conn   *grpc.ClientConn
+	buf    []byte
+}
+
+func (c *grpcChunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		var chunk []byte
+		if err := c.stream.RecvMsg(&chunk); err != nil {
+			return 0, err
+		}
+		c.buf = chunk
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *grpcChunkReader) Close() error {
+	return c.conn.Close()
+}
+
+// rawCodecName is the gRPC content-subtype registered for rawCodec.
+const rawCodecName = "raw"
+
+// rawCodec passes message bytes through a gRPC stream unmodified. It lets
+// GRPCTransport proxy an arbitrary debug RPC without depending on the
+// proto-generated types of every service it might front.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: unsupported type %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: unsupported type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return rawCodecName }
+
+func init() {
+	encoding.RegisterCodec(rawCodec{})
+}
@@ -0,0 +1,146 @@
+package debugproxies
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/internal/app/router"
+	"google.golang.org/grpc"
+)
+
+func TestSchemeSelectsRegisteredTransport(t *testing.T) {
+	var rph ReverseProxyHandler
+
+	var gotEndpoint Endpoint
+	rph.Transports = map[string]Transport{
+		"grpc": transportFunc(func(ctx context.Context, endpoint Endpoint, req *http.Request) (io.ReadCloser, http.Header, error) {
+			gotEndpoint = endpoint
+			return ioutil.NopCloser(strings.NewReader("grpc-body")), http.Header{}, nil
+		}),
+	}
+
+	ep := Endpoint{Service: "gitserver", Host: "gitserver-0:6060", Scheme: "grpc"}
+	rph.Populate([]Endpoint{ep})
+
+	rtr := mux.NewRouter()
+	rtr.PathPrefix("/-/debug").Name(router.Debug)
+	rph.AddToRouter(rtr.Get(router.Debug).Subrouter())
+
+	ctx := backend.WithAuthzBypass(context.Background())
+	link := fmt.Sprintf("http://example.com/-/debug/proxies/%s/pprof/profile", displayNameFromEndpoint(ep))
+	req := httptest.NewRequest("GET", link, nil)
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	rtr.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	if string(body) != "grpc-body" {
+		t.Errorf("expected grpc transport's body, got %q", body)
+	}
+	if gotEndpoint.Host != ep.Host {
+		t.Errorf("expected grpc transport to be dispatched with host %q, got %q", ep.Host, gotEndpoint.Host)
+	}
+}
+
+func TestRawCodecRoundTripsArbitraryBytes(t *testing.T) {
+	cases := [][]byte{
+		nil,
+		{},
+		[]byte("hello"),
+		bytes.Repeat([]byte{0xff, 0x00, 0x7f}, 1000),
+	}
+
+	for _, in := range cases {
+		marshaled, err := rawCodec{}.Marshal(&in)
+		if err != nil {
+			t.Fatalf("Marshal(%v): %v", in, err)
+		}
+
+		var out []byte
+		if err := rawCodec{}.Unmarshal(marshaled, &out); err != nil {
+			t.Fatalf("Unmarshal(%v): %v", marshaled, err)
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("expected round-trip of %v, got %v", in, out)
+		}
+	}
+}
+
+func TestRawCodecRejectsUnsupportedTypes(t *testing.T) {
+	if _, err := (rawCodec{}).Marshal("not a *[]byte"); err == nil {
+		t.Error("expected Marshal to reject a non-*[]byte value")
+	}
+	if err := (rawCodec{}).Unmarshal([]byte("data"), "not a *[]byte"); err == nil {
+		t.Error("expected Unmarshal to reject a non-*[]byte value")
+	}
+}
+
+// fakeClientStream is a grpc.ClientStream whose RecvMsg plays back a fixed
+// sequence of message chunks, then returns io.EOF. Embedding the (nil)
+// interface satisfies the rest of grpc.ClientStream's surface, which
+// grpcChunkReader never calls.
+type fakeClientStream struct {
+	grpc.ClientStream
+	chunks [][]byte
+	i      int
+}
+
+func (f *fakeClientStream) RecvMsg(m interface{}) error {
+	if f.i >= len(f.chunks) {
+		return io.EOF
+	}
+	p, ok := m.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected RecvMsg type %T", m)
+	}
+	*p = f.chunks[f.i]
+	f.i++
+	return nil
+}
+
+func TestGRPCChunkReaderBuffersAcrossSmallReads(t *testing.T) {
+	stream := &fakeClientStream{chunks: [][]byte{[]byte("hello"), []byte(" world")}}
+	r := &grpcChunkReader{stream: stream}
+
+	var got []byte
+	buf := make([]byte, 4) // smaller than either chunk, forcing buffering
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("unexpected Read error: %v", err)
+			}
+			break
+		}
+	}
+
+	if string(got) != "hello world" {
+		t.Errorf("expected \"hello world\", got %q", got)
+	}
+}
+
+func TestGRPCChunkReaderHandlesUnevenChunkSizes(t *testing.T) {
+	stream := &fakeClientStream{chunks: [][]byte{{1, 2, 3}, {4}, {5, 6}}}
+	r := &grpcChunkReader{stream: stream}
+
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, []byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("expected [1 2 3 4 5 6], got %v", got)
+	}
+}
@@ -0,0 +1,254 @@
+package extsvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// OAuthToken is the typed representation of the OAuth2 credentials stored in
+// an ExternalAccount's AuthData. It gives code host packages a single shared
+// shape for token expiry and refresh handling instead of each one parsing
+// that opaque JSON ad hoc.
+//
+// This file is the shared infrastructure (registry, persistence, revocation
+// dispatch) for that migration; no code host package has been switched over
+// to it yet; see RegisterTokenRefresher.
+type OAuthToken struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+	TokenType    string
+	Scopes       []string
+}
+
+// ToOAuth2Token converts t into the golang.org/x/oauth2 representation,
+// for use by Refresher implementations that build their TokenSource on top
+// of oauth2.Config.TokenSource.
+func (t OAuthToken) ToOAuth2Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		Expiry:       t.Expiry,
+		TokenType:    t.TokenType,
+	}
+}
+
+func oauthTokenFromOAuth2Token(tok *oauth2.Token, scopes []string) OAuthToken {
+	return OAuthToken{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		Expiry:       tok.Expiry,
+		TokenType:    tok.TokenType,
+		Scopes:       scopes,
+	}
+}
+
+// OAuthTokenFromAuthData parses an ExternalAccount's AuthData as an
+// OAuthToken. It returns an error if data is nil, isn't valid JSON, or has a
+// field whose JSON type doesn't match OAuthToken's. Unknown fields are
+// ignored and missing ones are left at their zero values.
+func OAuthTokenFromAuthData(data *json.RawMessage) (*OAuthToken, error) {
+	if data == nil {
+		return nil, fmt.Errorf("extsvc: account has no auth data")
+	}
+	var tok OAuthToken
+	if err := json.Unmarshal(*data, &tok); err != nil {
+		return nil, fmt.Errorf("extsvc: parsing auth data as OAuthToken: %w", err)
+	}
+	return &tok, nil
+}
+
+// Refresher knows how to refresh and revoke OAuth tokens for a single code
+// host type (ServiceType). Code host packages register one via
+// RegisterTokenRefresher during init.
+type Refresher interface {
+	// TokenSource returns an oauth2.TokenSource that transparently refreshes
+	// token once it's expired.
+	TokenSource(ctx context.Context, token *OAuthToken) oauth2.TokenSource
+	// RevokeToken revokes token at the code host, e.g. GitHub's
+	// DELETE /applications/{client_id}/token or GitLab's POST /oauth/revoke.
+	RevokeToken(ctx context.Context, token *OAuthToken) error
+}
+
+var (
+	refreshersMu sync.RWMutex
+	refreshers   = make(map[string]Refresher)
+)
+
+// RegisterTokenRefresher registers r as the Refresher used for accounts
+// whose ServiceType is serviceType (e.g. "github", "gitlab"). It is intended
+// to be called from the init() of each code host package that supports
+// OAuth.
+//
+// No code host package calls this yet: migrating github/gitlab's existing
+// ad-hoc token handling over to this registry, so that TokenSource and
+// RevokeToken actually do something in production, is tracked as a
+// follow-up and out of scope for this change.
+func RegisterTokenRefresher(serviceType string, r Refresher) {
+	refreshersMu.Lock()
+	defer refreshersMu.Unlock()
+	refreshers[serviceType] = r
+}
+
+// OAuth2ConfigRefresher is a Refresher built on a standard oauth2.Config,
+// usable as-is by any code host whose OAuth app follows the standard
+// authorization-code refresh flow (GitHub, GitLab, Bitbucket Cloud, ...).
+// Revocation is host-specific, so callers supply Revoke; a code host
+// package registers one of these during init, e.g.:
+//
+//	extsvc.RegisterTokenRefresher("github", extsvc.OAuth2ConfigRefresher{
+//		Config: githubOAuthConfig,
+//		Revoke: revokeGitHubToken,
+//	})
+type OAuth2ConfigRefresher struct {
+	Config *oauth2.Config
+	// Revoke dispatches the host-specific revocation request, e.g. GitHub's
+	// DELETE /applications/{client_id}/token or GitLab's POST /oauth/revoke.
+	Revoke func(ctx context.Context, cfg *oauth2.Config, token *OAuthToken) error
+}
+
+func (r OAuth2ConfigRefresher) TokenSource(ctx context.Context, token *OAuthToken) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(token.ToOAuth2Token(), r.Config.TokenSource(ctx, token.ToOAuth2Token()))
+}
+
+func (r OAuth2ConfigRefresher) RevokeToken(ctx context.Context, token *OAuthToken) error {
+	if r.Revoke == nil {
+		return fmt.Errorf("extsvc: OAuth2ConfigRefresher has no Revoke func configured")
+	}
+	return r.Revoke(ctx, r.Config, token)
+}
+
+func refresherFor(serviceType string) (Refresher, error) {
+	refreshersMu.RLock()
+	defer refreshersMu.RUnlock()
+	r, ok := refreshers[serviceType]
+	if !ok {
+		return nil, fmt.Errorf("extsvc: no token refresher registered for service type %q", serviceType)
+	}
+	return r, nil
+}
+
+// TokenStore persists refreshed OAuth tokens back to an account's row and
+// loads the current one for revocation. This package only defines the
+// interface; it is installed with SetTokenStore. No implementation backed by
+// the user_external_accounts table exists in this repository.
+type TokenStore interface {
+	// GetAuthData loads the current OAuthToken for spec.
+	GetAuthData(ctx context.Context, spec ExternalAccountSpec) (*OAuthToken, error)
+	// UpdateAuthData swaps spec's AuthData for token, under a row-level lock
+	// so concurrent refreshes of the same account don't race.
+	UpdateAuthData(ctx context.Context, spec ExternalAccountSpec, token OAuthToken) error
+}
+
+var (
+	tokenStoreMu sync.RWMutex
+	tokenStore   TokenStore
+)
+
+// SetTokenStore registers the TokenStore used by TokenSource and RevokeToken.
+//
+// Nothing outside this package's tests calls it, so outside tests
+// TokenSource and RevokeToken return a "no TokenStore configured" error.
+func SetTokenStore(s TokenStore) {
+	tokenStoreMu.Lock()
+	defer tokenStoreMu.Unlock()
+	tokenStore = s
+}
+
+func getTokenStore() (TokenStore, error) {
+	tokenStoreMu.RLock()
+	defer tokenStoreMu.RUnlock()
+	if tokenStore == nil {
+		return nil, fmt.Errorf("extsvc: no TokenStore configured (call SetTokenStore during startup)")
+	}
+	return tokenStore, nil
+}
+
+// TokenSource returns an oauth2.TokenSource for account that transparently
+// refreshes its token via the Refresher registered for account.ServiceType,
+// persisting any refreshed token back through the configured TokenStore.
+func TokenSource(ctx context.Context, account *ExternalAccount) (oauth2.TokenSource, error) {
+	refresher, err := refresherFor(account.ServiceType)
+	if err != nil {
+		return nil, err
+	}
+	store, err := getTokenStore()
+	if err != nil {
+		return nil, err
+	}
+	token, err := OAuthTokenFromAuthData(account.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	return &persistingTokenSource{
+		ctx:    ctx,
+		spec:   account.ExternalAccountSpec,
+		store:  store,
+		source: refresher.TokenSource(ctx, token),
+		last:   *token,
+	}, nil
+}
+
+// persistingTokenSource wraps a Refresher's oauth2.TokenSource, writing any
+// refreshed token back to the TokenStore the first time it changes.
+type persistingTokenSource struct {
+	ctx    context.Context
+	spec   ExternalAccountSpec
+	store  TokenStore
+	source oauth2.TokenSource
+
+	mu   sync.Mutex
+	last OAuthToken
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := p.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tok.AccessToken == p.last.AccessToken && tok.Expiry.Equal(p.last.Expiry) {
+		return tok, nil
+	}
+
+	refreshed := oauthTokenFromOAuth2Token(tok, p.last.Scopes)
+	if err := p.store.UpdateAuthData(p.ctx, p.spec, refreshed); err != nil {
+		return nil, fmt.Errorf("extsvc: persisting refreshed token for %s: %w", p.spec.ServiceType, err)
+	}
+	p.last = refreshed
+	return tok, nil
+}
+
+// RevokeToken revokes the OAuth token of the account identified by spec at
+// its code host, via the Refresher registered for spec.ServiceType. On
+// success it also clears the account's persisted AuthData, so the revoked
+// token isn't handed out again by a later TokenSource call.
+func RevokeToken(ctx context.Context, spec ExternalAccountSpec) error {
+	refresher, err := refresherFor(spec.ServiceType)
+	if err != nil {
+		return err
+	}
+	store, err := getTokenStore()
+	if err != nil {
+		return err
+	}
+	token, err := store.GetAuthData(ctx, spec)
+	if err != nil {
+		return fmt.Errorf("extsvc: loading auth data to revoke: %w", err)
+	}
+	if err := refresher.RevokeToken(ctx, token); err != nil {
+		return err
+	}
+	if err := store.UpdateAuthData(ctx, spec, OAuthToken{}); err != nil {
+		return fmt.Errorf("extsvc: clearing auth data after revoke: %w", err)
+	}
+	return nil
+}
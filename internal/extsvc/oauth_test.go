@@ -0,0 +1,203 @@
+package extsvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type fakeTokenStore struct {
+	mu      sync.Mutex
+	tokens  map[ExternalAccountSpec]OAuthToken
+	updates int
+}
+
+func newFakeTokenStore(initial map[ExternalAccountSpec]OAuthToken) *fakeTokenStore {
+	return &fakeTokenStore{tokens: initial}
+}
+
+func (s *fakeTokenStore) GetAuthData(ctx context.Context, spec ExternalAccountSpec) (*OAuthToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, ok := s.tokens[spec]
+	if !ok {
+		return nil, fmt.Errorf("fakeTokenStore: no token for %+v", spec)
+	}
+	cp := tok
+	return &cp, nil
+}
+
+func (s *fakeTokenStore) UpdateAuthData(ctx context.Context, spec ExternalAccountSpec, token OAuthToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[spec] = token
+	s.updates++
+	return nil
+}
+
+// fakeRefresher is a Refresher whose TokenSource always returns the same
+// oauth2.TokenSource, and which records every token it was asked to revoke.
+type fakeRefresher struct {
+	tokenSource oauth2.TokenSource
+	revoked     []*OAuthToken
+	revokeErr   error
+}
+
+func (f *fakeRefresher) TokenSource(ctx context.Context, token *OAuthToken) oauth2.TokenSource {
+	return f.tokenSource
+}
+
+func (f *fakeRefresher) RevokeToken(ctx context.Context, token *OAuthToken) error {
+	f.revoked = append(f.revoked, token)
+	return f.revokeErr
+}
+
+// staticTokenSource returns successive tokens from a fixed list, repeating
+// the last one once exhausted.
+type staticTokenSource struct {
+	tokens []*oauth2.Token
+	i      int
+}
+
+func (s *staticTokenSource) Token() (*oauth2.Token, error) {
+	tok := s.tokens[s.i]
+	if s.i < len(s.tokens)-1 {
+		s.i++
+	}
+	return tok, nil
+}
+
+func authDataFor(t *testing.T, token OAuthToken) ExternalAccountData {
+	t.Helper()
+	b, err := json.Marshal(token)
+	if err != nil {
+		t.Fatalf("marshaling auth data: %v", err)
+	}
+	raw := json.RawMessage(b)
+	return ExternalAccountData{AuthData: &raw}
+}
+
+func TestPersistingTokenSourcePersistsOnlyWhenTokenChanges(t *testing.T) {
+	spec := ExternalAccountSpec{ServiceType: "fake-persist", ServiceID: "fake.example.com", AccountID: "1"}
+	initial := OAuthToken{AccessToken: "old", Expiry: time.Unix(1000, 0)}
+	store := newFakeTokenStore(map[ExternalAccountSpec]OAuthToken{spec: initial})
+
+	refresher := &fakeRefresher{tokenSource: &staticTokenSource{tokens: []*oauth2.Token{
+		{AccessToken: "old", Expiry: time.Unix(1000, 0)},
+		{AccessToken: "new", Expiry: time.Unix(2000, 0)},
+		{AccessToken: "new", Expiry: time.Unix(2000, 0)},
+	}}}
+
+	RegisterTokenRefresher(spec.ServiceType, refresher)
+	SetTokenStore(store)
+	defer SetTokenStore(nil)
+
+	account := &ExternalAccount{ExternalAccountSpec: spec, ExternalAccountData: authDataFor(t, initial)}
+	source, err := TokenSource(context.Background(), account)
+	if err != nil {
+		t.Fatalf("TokenSource: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := source.Token(); err != nil {
+			t.Fatalf("Token() call %d: %v", i, err)
+		}
+	}
+
+	if store.updates != 1 {
+		t.Errorf("expected exactly one persisted update across 3 calls (1 unchanged + 2 identical refreshed), got %d", store.updates)
+	}
+	if got := store.tokens[spec]; got.AccessToken != "new" {
+		t.Errorf("expected the persisted token to be the refreshed one, got %+v", got)
+	}
+}
+
+func TestTokenSourceErrorsWithoutRegisteredRefresher(t *testing.T) {
+	SetTokenStore(newFakeTokenStore(nil))
+	defer SetTokenStore(nil)
+
+	account := &ExternalAccount{ExternalAccountSpec: ExternalAccountSpec{ServiceType: "never-registered"}}
+	if _, err := TokenSource(context.Background(), account); err == nil {
+		t.Error("expected an error for a service type with no registered Refresher")
+	}
+}
+
+func TestTokenSourceErrorsWithoutTokenStore(t *testing.T) {
+	RegisterTokenRefresher("fake-no-store", &fakeRefresher{})
+	SetTokenStore(nil)
+
+	account := &ExternalAccount{ExternalAccountSpec: ExternalAccountSpec{ServiceType: "fake-no-store"}}
+	if _, err := TokenSource(context.Background(), account); err == nil {
+		t.Error("expected an error when no TokenStore is configured")
+	}
+}
+
+func TestRevokeTokenClearsPersistedAuthData(t *testing.T) {
+	spec := ExternalAccountSpec{ServiceType: "fake-revoke", ServiceID: "fake.example.com", AccountID: "1"}
+	store := newFakeTokenStore(map[ExternalAccountSpec]OAuthToken{spec: {AccessToken: "secret", RefreshToken: "also-secret"}})
+	refresher := &fakeRefresher{}
+
+	RegisterTokenRefresher(spec.ServiceType, refresher)
+	SetTokenStore(store)
+	defer SetTokenStore(nil)
+
+	if err := RevokeToken(context.Background(), spec); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+
+	if len(refresher.revoked) != 1 || refresher.revoked[0].AccessToken != "secret" {
+		t.Errorf("expected the refresher to be asked to revoke the stored token, got %+v", refresher.revoked)
+	}
+	if got := store.tokens[spec]; got.AccessToken != "" || got.RefreshToken != "" {
+		t.Errorf("expected RevokeToken to clear the persisted auth data, got %+v", got)
+	}
+}
+
+func TestRevokeTokenLeavesAuthDataOnRevokerError(t *testing.T) {
+	spec := ExternalAccountSpec{ServiceType: "fake-revoke-err", ServiceID: "fake.example.com", AccountID: "1"}
+	original := OAuthToken{AccessToken: "secret"}
+	store := newFakeTokenStore(map[ExternalAccountSpec]OAuthToken{spec: original})
+	refresher := &fakeRefresher{revokeErr: fmt.Errorf("code host is down")}
+
+	RegisterTokenRefresher(spec.ServiceType, refresher)
+	SetTokenStore(store)
+	defer SetTokenStore(nil)
+
+	if err := RevokeToken(context.Background(), spec); err == nil {
+		t.Fatal("expected RevokeToken to propagate the code host's error")
+	}
+	if got := store.tokens[spec]; got.AccessToken != original.AccessToken {
+		t.Errorf("expected auth data to be left untouched after a failed revoke, got %+v", got)
+	}
+}
+
+func TestOAuth2ConfigRefresherDispatchesRevoke(t *testing.T) {
+	var gotToken *OAuthToken
+	refresher := OAuth2ConfigRefresher{
+		Config: &oauth2.Config{},
+		Revoke: func(ctx context.Context, cfg *oauth2.Config, token *OAuthToken) error {
+			gotToken = token
+			return nil
+		},
+	}
+
+	tok := &OAuthToken{AccessToken: "abc"}
+	if err := refresher.RevokeToken(context.Background(), tok); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if gotToken != tok {
+		t.Error("expected Revoke to be called with the given token")
+	}
+}
+
+func TestOAuth2ConfigRefresherRequiresRevokeFunc(t *testing.T) {
+	refresher := OAuth2ConfigRefresher{Config: &oauth2.Config{}}
+	if err := refresher.RevokeToken(context.Background(), &OAuthToken{}); err == nil {
+		t.Error("expected an error when no Revoke func is configured")
+	}
+}